@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/qfarm/qfarm/redis"
+)
+
+// EventTypeLogLine carries a single tailed build log line, in addition
+// to the existing one-line stage events Notifier already sends.
+const EventTypeLogLine = "log_line"
+
+// maxBuildLogLines caps how many lines of a single build's log are kept
+// in Redis, so a runaway linter can't grow logs:<repo>:<no> without
+// bound.
+const maxBuildLogLines = 5000
+
+// BuildLog tees a build's log lines into Redis under
+// logs:<repo>:<no>, capped to maxBuildLogLines, and notifies the
+// frontend of each new line so it can show a live tail instead of only
+// the single current-stage event.
+type BuildLog struct {
+	redis    *redis.Service
+	notifier *Notifier
+	repo     string
+	buildNo  int
+}
+
+// NewBuildLog builds a BuildLog for one build. Use Sink as the sink
+// passed to NewLogger so every Logger call is captured automatically.
+func NewBuildLog(redisSvc *redis.Service, notifier *Notifier, repo string, buildNo int) *BuildLog {
+	return &BuildLog{redis: redisSvc, notifier: notifier, repo: repo, buildNo: buildNo}
+}
+
+func (b *BuildLog) key() string {
+	return fmt.Sprintf("logs:%s:%d", b.repo, b.buildNo)
+}
+
+// Sink is a logger sink: append the line to the capped Redis list and
+// push it to the notifier for live tailing. It reports its own
+// failures through the standard log package rather than the Logger it
+// backs, since that Logger calls back into Sink on every line - routing
+// a Sink failure through it would recurse.
+func (b *BuildLog) Sink(level Level, line string) {
+	if err := b.redis.ListPushCapped(b.key(), []byte(line), maxBuildLogLines); err != nil {
+		log.Printf("buildlog: can't append to %s: %v\n", b.key(), err)
+		return
+	}
+
+	b.notifier.SendEventWithPayload(b.repo, line, EventTypeLogLine, fmt.Sprintf("%d", b.buildNo))
+}
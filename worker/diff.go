@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/qfarm/qfarm"
+	"github.com/qfarm/qfarm/redis"
+)
+
+// EventTypeBuildDiff carries a BuildDiff's storage key once a build's
+// diff against its predecessor has been computed and persisted.
+const EventTypeBuildDiff = "build_diff"
+
+// IssueKey identifies an issue independently of its exact line number,
+// so a diff between two builds isn't fooled by unrelated edits shifting
+// lines above it.
+type IssueKey struct {
+	File    string `json:"file"`
+	Linter  string `json:"linter"`
+	Message string `json:"message"`
+}
+
+// FileCoverageDelta is the coverage change for a single file between
+// two builds.
+type FileCoverageDelta struct {
+	File   string  `json:"file"`
+	Before float64 `json:"before"`
+	After  float64 `json:"after"`
+	Delta  float64 `json:"delta"`
+}
+
+// BuildDiff is what changed between a build and the one before it,
+// stored under diffs:<repo>:<no> so the frontend can show PR-style
+// "you introduced N new warnings" annotations.
+type BuildDiff struct {
+	Repo           string              `json:"repo"`
+	No             int                 `json:"no"`
+	PreviousNo     int                 `json:"previous_no"`
+	NewIssues      []qfarm.Issue       `json:"new_issues"`
+	FixedIssues    []qfarm.Issue       `json:"fixed_issues"`
+	CoverageDeltas []FileCoverageDelta `json:"coverage_deltas"`
+	ScoreDelta     int                 `json:"score_delta"`
+}
+
+// diffBuilds computes the BuildDiff between two full file trees,
+// translating the previous build's issue line numbers forward across
+// the commit range so edits above an issue don't look like the issue
+// itself moved.
+func diffBuilds(repo string, newBuild qfarm.Report, newTree, oldTree *FilesMap, oldCommit, newCommit string) (BuildDiff, error) {
+	hunks, err := blameHunks(repo, oldCommit, newCommit)
+	if err != nil {
+		return BuildDiff{}, fmt.Errorf("can't compute blame hunks: %v", err)
+	}
+
+	oldByKey := bucketIssuesByKey(repo, oldTree, hunks)
+	newByKey := bucketIssuesByKey(repo, newTree, nil)
+
+	diff := BuildDiff{Repo: repo, No: newBuild.No, PreviousNo: newBuild.No - 1}
+
+	// Match occurrences pairwise within each key: the Nth occurrence of
+	// a (file, linter, message) in the old build pairs off with the Nth
+	// occurrence in the new build, so a file with two copies of the same
+	// warning where only one gets fixed still reports one fix instead
+	// of the change disappearing into a key that "exists in both".
+	for key, newIssues := range newByKey {
+		oldIssues := oldByKey[key]
+		if len(newIssues) > len(oldIssues) {
+			diff.NewIssues = append(diff.NewIssues, newIssues[len(oldIssues):]...)
+		}
+	}
+	for key, oldIssues := range oldByKey {
+		newIssues := newByKey[key]
+		if len(oldIssues) > len(newIssues) {
+			diff.FixedIssues = append(diff.FixedIssues, oldIssues[len(newIssues):]...)
+		}
+	}
+
+	diff.CoverageDeltas = coverageDeltas(newTree, oldTree)
+
+	return diff, nil
+}
+
+// bucketIssuesByKey walks a file tree and indexes every issue by
+// (file, linter, message), translating each issue's line forward
+// through hunks (if given) so it lines up with the other build's
+// issues at the same logical location. Multiple issues sharing a key
+// (e.g. the same message twice in one file) are kept as a slice rather
+// than collapsed, so diffBuilds can match them up one-to-one instead of
+// treating the key as either wholly present or wholly absent.
+func bucketIssuesByKey(repo string, tree *FilesMap, hunks map[string][]lineHunk) map[IssueKey][]qfarm.Issue {
+	out := make(map[IssueKey][]qfarm.Issue)
+	if tree == nil {
+		return out
+	}
+
+	for _, node := range tree.FilesMap {
+		if node.Dir {
+			continue
+		}
+		relPath := relativePath(repo, node.Path)
+		for _, issue := range node.Issues {
+			translated := issue
+			if fileHunks, ok := hunks[relPath]; ok {
+				translated.Line = translateLine(issue.Line, fileHunks)
+			}
+			key := IssueKey{File: relPath, Linter: issue.Linter, Message: issue.Message}
+			out[key] = append(out[key], translated)
+		}
+	}
+
+	return out
+}
+
+// relativePath strips the $GOPATH/src/<repo>/ prefix BuildTree stamps
+// onto a node's Path, matching the path `git diff` reports a changed
+// file under (relative to the repo root).
+func relativePath(repo, nodePath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(nodePath, gopathSrc(repo)), "/")
+}
+
+// coverageDeltas compares per-file coverage between two trees, only
+// reporting files present in both (new files show up in NewIssues
+// instead, removed files don't need a coverage annotation).
+func coverageDeltas(newTree, oldTree *FilesMap) []FileCoverageDelta {
+	var deltas []FileCoverageDelta
+	if newTree == nil || oldTree == nil {
+		return deltas
+	}
+
+	for path, node := range newTree.FilesMap {
+		if node.Dir {
+			continue
+		}
+		old, ok := oldTree.FilesMap[path]
+		if !ok {
+			continue
+		}
+
+		deltas = append(deltas, FileCoverageDelta{
+			File:   node.Path,
+			Before: old.Coverage,
+			After:  node.Coverage,
+			Delta:  node.Coverage - old.Coverage,
+		})
+	}
+
+	return deltas
+}
+
+// lineHunk is one git-diff hunk: oldStart/oldLines map to
+// newStart/newLines, used to translate a line number from the old
+// commit forward to the new one.
+type lineHunk struct {
+	oldStart, oldLines int
+	newStart, newLines int
+}
+
+// translateLine maps an old line number through a file's hunks to
+// where it now lives. Lines inside a hunk's old range are considered
+// touched by the commit range and snapped to the start of the new
+// range, rather than guessed at more precisely.
+func translateLine(line int, hunks []lineHunk) int {
+	offset := 0
+	for _, h := range hunks {
+		oldStart := h.oldStart
+		if h.oldLines == 0 {
+			// a pure insertion names the old line it follows
+			oldStart++
+		}
+		if line < oldStart {
+			break
+		}
+		if line < oldStart+h.oldLines {
+			return h.newStart
+		}
+		offset += h.newLines - h.oldLines
+	}
+
+	return line + offset
+}
+
+// blameHunks runs `git diff` between oldCommit and newCommit and
+// returns each changed file's hunks, used to translate the old build's
+// issue line numbers forward.
+func blameHunks(repo, oldCommit, newCommit string) (map[string][]lineHunk, error) {
+	repoPath := gopathSrc(repo)
+
+	cmd := exec.Command("git", "diff", "--unified=0", oldCommit+".."+newCommit)
+	cmd.Dir = repoPath
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUnifiedHunks(out), nil
+}
+
+// hunkHeader matches a unified diff hunk header, e.g. "@@ -12,3 +12,5 @@".
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseUnifiedHunks extracts each file's hunks from `git diff
+// --unified=0` output, keyed by the path relative to the repo root (as
+// relativePath derives it from a node's Path field). Hunks of deleted
+// files are not kept under any file's path.
+func parseUnifiedHunks(diffOutput []byte) map[string][]lineHunk {
+	hunks := make(map[string][]lineHunk)
+	var currentFile string
+
+	for _, line := range strings.Split(string(diffOutput), "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++ b/"):
+			currentFile = strings.TrimPrefix(line, "+++ b/")
+		case strings.HasPrefix(line, "+++ "):
+			currentFile = ""
+		case hunkHeader.MatchString(line):
+			m := hunkHeader.FindStringSubmatch(line)
+			hunks[currentFile] = append(hunks[currentFile], lineHunk{
+				oldStart: atoiOrOne(m[1]),
+				oldLines: atoiOrDefault(m[2], 1),
+				newStart: atoiOrOne(m[3]),
+				newLines: atoiOrDefault(m[4], 1),
+			})
+		}
+	}
+
+	return hunks
+}
+
+func atoiOrOne(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 1
+	}
+	return n
+}
+
+func atoiOrDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	return atoiOrOne(s)
+}
+
+func gopathSrc(repo string) string {
+	return path.Join(os.Getenv("GOPATH"), "src", repo)
+}
+
+func (w *Worker) storeBuildDiff(diff BuildDiff) error {
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("diffs:%s:%d", diff.Repo, diff.No)
+	if err := w.redis.Set(key, -1, string(data)); err != nil {
+		return err
+	}
+
+	w.notifier.SendEventWithPayload(diff.Repo, "Build diff ready", EventTypeBuildDiff, key)
+	return nil
+}
+
+func (w *Worker) loadFileTree(repo string, no int) (*FilesMap, error) {
+	data, err := w.redis.Get(fmt.Sprintf("trees:%s:%d", repo, no))
+	if err == redis.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ft FilesMap
+	if err := json.Unmarshal(data.([]byte), &ft); err != nil {
+		return nil, err
+	}
+
+	return &ft, nil
+}
@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// dockerClient lazily creates a single Docker client reused across
+// every DockerRunner, so each build doesn't pay for a fresh connection
+// to the daemon.
+var dockerClient *client.Client
+
+func getDockerClient() (*client.Client, error) {
+	if dockerClient != nil {
+		return dockerClient, nil
+	}
+
+	c, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	dockerClient = c
+	return dockerClient, nil
+}
+
+func dockerCreate(ctx context.Context, image string, cmd []string, checkoutPath string, env []string, limits ResourceLimits) (string, error) {
+	c, err := getDockerClient()
+	if err != nil {
+		return "", err
+	}
+
+	if err := ensureImage(ctx, c, image); err != nil {
+		return "", err
+	}
+
+	hostCfg := &container.HostConfig{
+		Binds:      []string{checkoutPath + ":" + checkoutPath + ":ro"},
+		AutoRemove: false,
+	}
+
+	if limits.MemoryMB > 0 {
+		hostCfg.Resources.Memory = limits.MemoryMB * 1024 * 1024
+	}
+	if limits.CPUs > 0 {
+		hostCfg.Resources.NanoCPUs = int64(limits.CPUs * 1e9)
+	}
+
+	resp, err := c.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Cmd:        cmd,
+		Env:        env,
+		WorkingDir: checkoutPath,
+		Tty:        false,
+	}, hostCfg, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	return resp.ID, nil
+}
+
+// ensureImage pulls image if the daemon doesn't already have it
+// cached, so a repo's RepoCfg.Image override (the point of letting a
+// repo pick its own Go version/linter set) doesn't require the image to
+// have been manually pre-pulled onto every worker host.
+func ensureImage(ctx context.Context, c *client.Client, image string) error {
+	if _, _, err := c.ImageInspectWithRaw(ctx, image); err == nil {
+		return nil
+	}
+
+	reader, err := c.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+func dockerStart(ctx context.Context, containerID string) error {
+	c, err := getDockerClient()
+	if err != nil {
+		return err
+	}
+
+	return c.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+}
+
+func dockerLogs(ctx context.Context, containerID string) (io.ReadCloser, error) {
+	c, err := getDockerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+}
+
+func dockerWait(ctx context.Context, containerID string) (int, error) {
+	c, err := getDockerClient()
+	if err != nil {
+		return -1, err
+	}
+
+	statusCh, errCh := c.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return -1, err
+	case status := <-statusCh:
+		return int(status.StatusCode), nil
+	}
+}
+
+func dockerRemove(containerID string) error {
+	c, err := getDockerClient()
+	if err != nil {
+		return err
+	}
+
+	return c.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{
+		Force: true,
+	})
+}
@@ -0,0 +1,221 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// GitFetcher keeps a bare mirror of every analyzed repo under CacheDir
+// and checks out the requested ref into GOPATH for linting. This avoids
+// re-downloading the whole dependency tree on every build and lets
+// re-analysis of historical builds pin to the exact commit they ran
+// against.
+type GitFetcher struct {
+	cacheDir string
+	config   *Cfg
+}
+
+// NewGitFetcher builds a GitFetcher rooted at config.CacheDir.
+func NewGitFetcher(config *Cfg) *GitFetcher {
+	return &GitFetcher{cacheDir: config.CacheDir, config: config}
+}
+
+// Fetch makes sure repo's bare mirror exists and is up to date, then
+// checks out ref (a branch, tag or commit sha) into
+// $GOPATH/src/<repo>, replacing whatever was checked out there before.
+func (f *GitFetcher) Fetch(repo, ref string) error {
+	mirror := path.Join(f.cacheDir, repo)
+
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		if err := f.clone(repo, mirror); err != nil {
+			return fmt.Errorf("can't clone %s: %v", repo, err)
+		}
+	} else if err := f.fetchPrune(repo, mirror); err != nil {
+		return fmt.Errorf("can't update mirror for %s: %v", repo, err)
+	}
+
+	dest := path.Join(os.Getenv("GOPATH"), "src", repo)
+	if err := f.checkout(mirror, dest, ref); err != nil {
+		return fmt.Errorf("can't checkout %s@%s: %v", repo, ref, err)
+	}
+
+	if err := f.resolveDependencies(dest); err != nil {
+		return fmt.Errorf("can't resolve dependencies for %s: %v", repo, err)
+	}
+
+	return nil
+}
+
+// resolveDependencies fetches the checkout's dependencies, deliberately
+// kept separate from the checkout step above: a vendor/ directory
+// committed by the repo is used as-is, otherwise a committed go.sum
+// triggers `go mod download`, and a checkout with neither is left
+// untouched.
+func (f *GitFetcher) resolveDependencies(dest string) error {
+	if _, err := os.Stat(path.Join(dest, "vendor")); err == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(path.Join(dest, "go.sum")); err != nil {
+		return nil
+	}
+
+	cmd := exec.Command("go", "mod", "download")
+	cmd.Dir = dest
+	cmd.Env = append(f.gitEnv(), "GO111MODULE=on")
+	return cmd.Run()
+}
+
+func (f *GitFetcher) clone(repo, mirror string) error {
+	if err := os.MkdirAll(path.Dir(mirror), 0755); err != nil {
+		return err
+	}
+
+	return f.runAuthenticatedGit(repo, "", "clone", "--mirror", f.remoteURL(repo), mirror)
+}
+
+func (f *GitFetcher) fetchPrune(repo, mirror string) error {
+	return f.runAuthenticatedGit(repo, mirror, "fetch", "--prune")
+}
+
+// checkout replaces dest with a detached worktree of the mirror at ref.
+// Any previous worktree registration for dest is pruned first so
+// re-analyzing an old build doesn't fail with "already checked out".
+func (f *GitFetcher) checkout(mirror, dest, ref string) error {
+	prune := exec.Command("git", "worktree", "prune")
+	prune.Dir = mirror
+	if err := prune.Run(); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	add := exec.Command("git", "worktree", "add", "--detach", "--force", dest, ref)
+	add.Dir = mirror
+	return add.Run()
+}
+
+// runAuthenticatedGit runs a git subcommand against repo's host,
+// feeding any configured credential to git through GIT_ASKPASS rather
+// than embedding it in the URL: an embedded user:token@host URL shows
+// up in argv for any local user to read off /proc/<pid>/cmdline or `ps
+// aux`, which matters on the same worker host that chunk0-3 has
+// running untrusted user code in containers.
+func (f *GitFetcher) runAuthenticatedGit(repo, dir string, args ...string) error {
+	env, cleanup, err := f.credentialEnv(repo)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(f.gitEnv(), env...)
+	return cmd.Run()
+}
+
+// credentialEnv returns the extra environment variables needed to
+// authenticate against repo's host, plus a cleanup func that must be
+// called once the git command has finished. For hosts without a
+// configured token, both are no-ops.
+func (f *GitFetcher) credentialEnv(repo string) ([]string, func(), error) {
+	host := splitHostPath(repo).host
+	cred, ok := f.config.GitCredentials[host]
+	if !ok || cred.SSH || cred.Token == "" {
+		return nil, func() {}, nil
+	}
+
+	askpass, cleanup, err := writeAskpassScript(cred.Token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't write askpass helper: %v", err)
+	}
+
+	return []string{"GIT_ASKPASS=" + askpass}, cleanup, nil
+}
+
+// writeAskpassScript writes a throwaway, owner-only-readable script
+// that prints token to stdout regardless of the prompt git's HTTPS
+// transport shows it (username or password), and returns a cleanup
+// func that removes it.
+func writeAskpassScript(token string) (string, func(), error) {
+	f, err := ioutil.TempFile("", "qfarm-askpass-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	script := fmt.Sprintf("#!/bin/sh\necho %q\n", token)
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	if err := os.Chmod(f.Name(), 0700); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// defaultTokenUser is the username git's HTTPS Basic-Auth transport
+// expects in the username slot when a host is configured with only a
+// Token and no User - a convention GitHub (among others) documents
+// explicitly, and a harmless placeholder everywhere else since the
+// token itself, not the username, is what's checked.
+const defaultTokenUser = "x-access-token"
+
+// remoteURL turns a Go-style import path into a clone URL, using SSH
+// when the host's credentials are marked SSH and plain HTTPS (with just
+// the username, if any - credentialEnv supplies the secret separately)
+// otherwise.
+func (f *GitFetcher) remoteURL(repo string) string {
+	parts := splitHostPath(repo)
+	cred, ok := f.config.GitCredentials[parts.host]
+	if !ok {
+		return "https://" + repo
+	}
+
+	if cred.SSH {
+		return fmt.Sprintf("git@%s:%s.git", parts.host, parts.path)
+	}
+
+	user := cred.User
+	if user == "" && cred.Token != "" {
+		user = defaultTokenUser
+	}
+	if user != "" {
+		return fmt.Sprintf("https://%s@%s/%s", user, parts.host, parts.path)
+	}
+
+	return "https://" + repo
+}
+
+func (f *GitFetcher) gitEnv() []string {
+	return append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+}
+
+type hostPath struct {
+	host string
+	path string
+}
+
+func splitHostPath(repo string) hostPath {
+	for i := 0; i < len(repo); i++ {
+		if repo[i] == '/' {
+			return hostPath{host: repo[:i], path: repo[i+1:]}
+		}
+	}
+	return hostPath{host: repo}
+}
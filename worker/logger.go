@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Level is a logging severity, ordered from least to most severe.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Logger is a structured, leveled logger. Fields tags every subsequent
+// entry with the given key/value pairs (repo, build_no, stage, ...)
+// without the caller having to repeat them on every call; it's
+// satisfied by the go-logging/zerolog/glog-style adapters the rest of
+// qfarm already wires into its other services.
+type Logger interface {
+	Fields(fields map[string]interface{}) Logger
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger is a minimal Logger backed by the standard library's log
+// package, used when the host application doesn't wire in one of its
+// own. It also tees every line it writes to a sink (such as a
+// BuildLog's Sink), so a single log call both prints to the worker's
+// own stdout and feeds the live build log tail.
+type stdLogger struct {
+	fields map[string]interface{}
+	out    *log.Logger
+	sink   func(level Level, line string)
+}
+
+// NewLogger builds the default Logger. sink may be nil, in which case
+// log lines are only printed, not captured anywhere.
+func NewLogger(sink func(level Level, line string)) Logger {
+	return &stdLogger{
+		out:  log.New(os.Stdout, "", log.LstdFlags),
+		sink: sink,
+	}
+}
+
+func (l *stdLogger) Fields(fields map[string]interface{}) Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return &stdLogger{fields: merged, out: l.out, sink: l.sink}
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+func (l *stdLogger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *stdLogger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *stdLogger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+func (l *stdLogger) logf(level Level, format string, args ...interface{}) {
+	line := fmt.Sprintf("[%s] %s %s", level, l.fieldsString(), fmt.Sprintf(format, args...))
+	l.out.Println(line)
+	if l.sink != nil {
+		l.sink(level, line)
+	}
+}
+
+func (l *stdLogger) fieldsString() string {
+	if len(l.fields) == 0 {
+		return ""
+	}
+
+	s := ""
+	for k, v := range l.fields {
+		s += fmt.Sprintf("%s=%v ", k, v)
+	}
+	return s
+}
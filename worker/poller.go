@@ -0,0 +1,235 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/qfarm/qfarm/redis"
+)
+
+// Poller periodically checks every registered repo's Git host for new
+// commits and enqueues an analysis when the newest ref moves past the
+// last build's CommitHash. It covers the repos that aren't wired up to
+// a webhook (or as a backstop when a webhook delivery is missed).
+type Poller struct {
+	config   *Cfg
+	redis    *redis.Service
+	notifier *Notifier
+	trigger  func(repo string) error
+	logger   Logger
+
+	client *http.Client
+}
+
+// NewPoller builds a Poller. trigger is called with a repo name whenever
+// a newer commit is found; Worker wires it to pushing onto test-q-list.
+func NewPoller(config *Cfg, redisSvc *redis.Service, notifier *Notifier, trigger func(repo string) error, logger Logger) *Poller {
+	return &Poller{
+		config:   config,
+		redis:    redisSvc,
+		notifier: notifier,
+		trigger:  trigger,
+		logger:   logger.Fields(map[string]interface{}{"stage": "poll"}),
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Run blocks, polling every config.PollInterval until stop is closed.
+func (p *Poller) Run(stop <-chan struct{}) {
+	if !p.config.PollEnabled {
+		return
+	}
+
+	interval := p.config.PollInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	backoff := interval
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		if err := p.pollOnce(); err != nil {
+			p.logger.Errorf("tick failed: %v", err)
+			backoff *= 2
+			if max := p.config.PollMaxBackoff; max > 0 && backoff > max {
+				backoff = max
+			}
+			continue
+		}
+
+		backoff = interval
+	}
+}
+
+func (p *Poller) pollOnce() error {
+	userRepoKeys, err := p.redis.ScanKeys("users:*:repos")
+	if err != nil {
+		return fmt.Errorf("can't list registered users: %v", err)
+	}
+
+	for _, userRepoKey := range userRepoKeys {
+		repos, err := p.redis.SortedSetMembers(userRepoKey)
+		if err != nil {
+			p.logger.Errorf("%s: can't list repos: %v", userRepoKey, err)
+			continue
+		}
+
+		for _, repo := range repos {
+			p.pollRepo(repo)
+		}
+	}
+
+	return nil
+}
+
+func (p *Poller) pollRepo(repo string) {
+	repoCfg := p.config.Repos[repo]
+	if repoCfg.PollDisabled {
+		return
+	}
+
+	head, err := p.remoteHead(repo, repoCfg)
+	if err != nil {
+		p.logger.Errorf("%s: %v", repo, err)
+		return
+	}
+
+	buildInfo, err := p.lastCommitHashFor(repo)
+	if err != nil && err != redis.ErrNotFound {
+		p.logger.Errorf("%s: can't load last build: %v", repo, err)
+		return
+	}
+
+	if buildInfo == head {
+		return
+	}
+
+	if err := p.trigger(repo); err != nil {
+		p.logger.Errorf("%s: can't trigger analysis: %v", repo, err)
+	}
+}
+
+func (p *Poller) lastCommitHashFor(repo string) (string, error) {
+	data, err := p.redis.ListGetLast("builds:" + repo)
+	if err != nil {
+		return "", err
+	}
+
+	var build struct {
+		CommitHash string `json:"CommitHash"`
+	}
+	if err := json.Unmarshal(data.([]byte), &build); err != nil {
+		return "", err
+	}
+
+	return build.CommitHash, nil
+}
+
+// remoteHead asks the repo's Git host for its newest commit, using
+// either the GitHub events API or Gerrit's `?format=JSON` meta endpoint
+// depending on the host in repo's path. On GitHub that is the head of
+// the most recent push event, whichever branch it went to; on Gerrit it
+// is the revision of the master branch.
+func (p *Poller) remoteHead(repo string, repoCfg RepoPollCfg) (string, error) {
+	switch {
+	case strings.HasPrefix(repo, "github.com/"):
+		return p.githubHead(repo, repoCfg)
+	default:
+		return p.gerritHead(repo, repoCfg)
+	}
+}
+
+func (p *Poller) githubHead(repo string, repoCfg RepoPollCfg) (string, error) {
+	ownerRepo := strings.TrimPrefix(repo, "github.com/")
+	url := fmt.Sprintf("https://api.github.com/repos/%s/events", ownerRepo)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if p.config.GitHubToken != "" {
+		req.Header.Set("Authorization", "token "+p.config.GitHubToken)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("github events api returned %s", resp.Status)
+	}
+
+	var events []struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Head string `json:"head"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return "", err
+	}
+
+	for _, e := range events {
+		if e.Type == "PushEvent" && e.Payload.Head != "" {
+			return e.Payload.Head, nil
+		}
+	}
+
+	return "", fmt.Errorf("no PushEvent found for %s", repo)
+}
+
+func (p *Poller) gerritHead(repo string, repoCfg RepoPollCfg) (string, error) {
+	host := repoCfg.GerritHost
+	if host == "" {
+		host = p.config.DefaultGerritHost
+	}
+	if host == "" {
+		return "", fmt.Errorf("no gerrit host configured for %s", repo)
+	}
+
+	// Gerrit project names routinely contain slashes (repos are
+	// recorded as host/org/project); the branches endpoint requires
+	// them percent-encoded or the lookup 404s.
+	url := fmt.Sprintf("%s/projects/%s/branches/%s?format=JSON", host, neturl.PathEscape(repo), "master")
+
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gerrit meta endpoint returned %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// Gerrit prefixes its JSON responses with a magic )]}' line to guard
+	// against JSON hijacking; strip it before decoding.
+	body = bytes.TrimPrefix(body, []byte(")]}'\n"))
+
+	var branch struct {
+		Revision string `json:"revision"`
+	}
+	if err := json.Unmarshal(body, &branch); err != nil {
+		return "", err
+	}
+
+	return branch.Revision, nil
+}
@@ -0,0 +1,273 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qfarm/qfarm/redis"
+)
+
+const (
+	queueList           = "test-q-list"
+	processingListFmt   = "processing:%s"
+	deadLetterList      = "test-q-dead-letter"
+	inProgressSortedSet = "builds:in-progress"
+
+	defaultVisibilityTimeout = 10 * time.Minute
+	defaultMaxRetries        = 3
+
+	// claimPollTimeout bounds how long a single Claim call blocks
+	// waiting for a job, independent of visibilityTimeout. It's kept
+	// short so an empty queue (the common case once more than one
+	// worker is subscribed) doesn't stall the pubsub callback that
+	// calls Claim.
+	claimPollTimeout = 2 * time.Second
+)
+
+// Job is a single queued repo build, tracked through claim, retry and
+// (if it keeps failing) dead-letter.
+type Job struct {
+	Repo    string `json:"repo"`
+	Retries int    `json:"retries"`
+
+	// raw is the exact bytes this job was read off the queue with, so
+	// it can be removed from a processing list with LREM without
+	// re-encoding (and risking a byte-for-byte mismatch). workerID is
+	// the worker that claimed it, so Reap knows whose processing list
+	// to clean up. Neither round-trips through JSON.
+	raw      []byte
+	workerID string
+}
+
+// Queue is a Redis-backed job broker sitting in front of Worker.analyze,
+// replacing the old bare ListPop: claims are atomic and visible to a
+// reaper, failed jobs are retried with backoff up to a limit and then
+// dead-lettered, and in-flight work is visible to the UI via a sorted
+// set instead of disappearing the moment a worker pops it.
+type Queue struct {
+	redis             *redis.Service
+	workerID          string
+	visibilityTimeout time.Duration
+	maxRetries        int
+}
+
+// NewQueue builds a Queue for one worker process. workerID must be
+// unique per process (e.g. hostname:pid) so its processing list doesn't
+// collide with another worker's.
+func NewQueue(redisSvc *redis.Service, workerID string, config *Cfg) *Queue {
+	visibilityTimeout := config.QueueVisibilityTimeout
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = defaultVisibilityTimeout
+	}
+
+	maxRetries := config.QueueMaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	return &Queue{
+		redis:             redisSvc,
+		workerID:          workerID,
+		visibilityTimeout: visibilityTimeout,
+		maxRetries:        maxRetries,
+	}
+}
+
+func (q *Queue) processingList() string {
+	return fmt.Sprintf(processingListFmt, q.workerID)
+}
+
+// Claim atomically moves the next job from the shared queue onto this
+// worker's processing list and marks it in-progress, so a crash between
+// claiming and finishing leaves the job visible to the reaper instead
+// of silently lost. Returns redis.ErrNotFound if no job turns up within
+// claimPollTimeout.
+func (q *Queue) Claim() (Job, error) {
+	data, err := q.redis.BRPopLPush(queueList, q.processingList(), claimPollTimeout)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job, err := decodeJob(data)
+	if err != nil {
+		return Job{}, err
+	}
+	job.workerID = q.workerID
+
+	score := float64(time.Now().Add(q.visibilityTimeout).Unix())
+	if err := q.redis.SortedSetAdd(inProgressSortedSet, inProgressMember(job), score); err != nil {
+		return Job{}, err
+	}
+
+	return job, nil
+}
+
+// Heartbeat pushes job's in-progress visibility deadline back out by
+// visibilityTimeout. Call it periodically for the duration of whatever
+// is processing job so a build that's merely slow - a cold image pull,
+// a large repo's lint pass - isn't reclaimed by the reaper and handed
+// to a second worker out from under the first.
+func (q *Queue) Heartbeat(job Job) error {
+	score := float64(time.Now().Add(q.visibilityTimeout).Unix())
+	return q.redis.SortedSetAdd(inProgressSortedSet, inProgressMember(job), score)
+}
+
+// heartbeatInterval returns how often Heartbeat must be called to stay
+// safely ahead of visibilityTimeout elapsing.
+func (q *Queue) heartbeatInterval() time.Duration {
+	return q.visibilityTimeout / 3
+}
+
+// Ack removes a successfully finished job from this worker's processing
+// list and the in-progress set.
+func (q *Queue) Ack(job Job) error {
+	if err := q.redis.ListRemove(q.processingList(), job.raw); err != nil {
+		return err
+	}
+
+	return q.redis.SortedSetRemove(inProgressSortedSet, inProgressMember(job))
+}
+
+// Fail removes job from this worker's processing list and either
+// re-queues it with its retry count incremented, or moves it to the
+// dead-letter list once maxRetries is exceeded.
+func (q *Queue) Fail(job Job) error {
+	if err := q.redis.ListRemove(q.processingList(), job.raw); err != nil {
+		return err
+	}
+	if err := q.redis.SortedSetRemove(inProgressSortedSet, inProgressMember(job)); err != nil {
+		return err
+	}
+
+	return q.requeueOrDeadLetter(job)
+}
+
+// requeueOrDeadLetter increments job's retry count and either pushes it
+// back onto the shared queue (with a short backoff) or, once
+// maxRetries is exceeded, onto the dead-letter list. Shared by Fail and
+// Reap so a job that crashes its worker is still bounded by the same
+// retry limit as one that fails in-process.
+func (q *Queue) requeueOrDeadLetter(job Job) error {
+	job.Retries++
+	if job.Retries > q.maxRetries {
+		return q.redis.ListPush(deadLetterList, encodeJob(job))
+	}
+
+	// exponential backoff: delay the requeue rather than hammering a
+	// repo that's failing because of a transient host outage.
+	time.Sleep(time.Second << uint(job.Retries-1))
+	return q.redis.ListPush(queueList, encodeJob(job))
+}
+
+// Reap scans the in-progress set for jobs whose visibility timeout has
+// elapsed without an Ack or Fail (most likely because the worker
+// holding them crashed), removes them from that worker's now-stale
+// processing list, and re-queues them through the same retry/dead-letter
+// path Fail uses, so a job that keeps crashing its worker is still
+// bounded by maxRetries instead of looping forever with its retry
+// count reset.
+func (q *Queue) Reap() error {
+	now := float64(time.Now().Unix())
+	expired, err := q.redis.SortedSetRangeByScore(inProgressSortedSet, 0, now)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range expired {
+		workerID, raw, ok := splitInProgressMember(member)
+		if !ok {
+			continue
+		}
+
+		job, err := decodeJob([]byte(raw))
+		if err != nil {
+			return err
+		}
+		job.raw = []byte(raw)
+		job.workerID = workerID
+
+		if err := q.redis.ListRemove(fmt.Sprintf(processingListFmt, workerID), job.raw); err != nil {
+			return err
+		}
+		if err := q.redis.SortedSetRemove(inProgressSortedSet, member); err != nil {
+			return err
+		}
+
+		if err := q.requeueOrDeadLetter(job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Shutdown returns every job this worker currently holds back onto the
+// shared queue, so a graceful SIGTERM doesn't strand in-flight work
+// behind this worker's dead processing list.
+func (q *Queue) Shutdown() error {
+	for {
+		data, err := q.redis.ListPop(q.processingList())
+		if err == redis.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := q.redis.ListPush(queueList, data.([]byte)); err != nil {
+			return err
+		}
+	}
+}
+
+// inProgressMember encodes a claimed job's in-progress set entry as
+// "<workerID>\x00<raw job bytes>", so Reap can recover both which
+// worker's processing list to clean up and the exact bytes to remove
+// from it.
+func inProgressMember(job Job) string {
+	return job.workerID + "\x00" + string(job.raw)
+}
+
+func splitInProgressMember(member string) (workerID, raw string, ok bool) {
+	i := strings.IndexByte(member, 0)
+	if i < 0 {
+		return "", "", false
+	}
+	return member[:i], member[i+1:], true
+}
+
+func encodeJob(job Job) []byte {
+	data, _ := json.Marshal(job)
+	return data
+}
+
+func decodeJob(data interface{}) (Job, error) {
+	raw := toBytes(data)
+
+	// Jobs pushed by the poller/webhook are bare repo names; wrap them
+	// the first time they're claimed so retry bookkeeping has
+	// somewhere to live.
+	if len(raw) == 0 || raw[0] != '{' {
+		return Job{Repo: string(raw), raw: raw}, nil
+	}
+
+	var job Job
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return Job{}, err
+	}
+	job.raw = raw
+	return job, nil
+}
+
+func toBytes(data interface{}) []byte {
+	switch v := data.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// defaultLinterTimeout is used when neither a repo's LinterTimeout nor
+// config.DefaultLinterTimeout is set, so a missing config value fails a
+// build slowly instead of instantly via an already-expired context.
+const defaultLinterTimeout = 10 * time.Minute
+
+// Runner executes a linter/coverage command against a checkout and
+// streams its output back line-by-line. Metalinter.Start and
+// CoverageChecker.Start are built against this interface rather than
+// shelling out directly, so the same worker host can run untrusted
+// user code inside an isolated, per-repo toolchain instead of the
+// worker's own environment.
+type Runner interface {
+	// Run executes cmd (argv form) with checkoutPath bind-mounted
+	// read-only, calling onLine for every line written to stdout or
+	// stderr as it arrives. Run blocks until the command exits, the
+	// timeout elapses, or ctx is cancelled, and returns the command's
+	// exit code.
+	Run(ctx context.Context, cmd []string, checkoutPath string, onLine func(line string)) (exitCode int, err error)
+}
+
+// DockerRunner runs commands inside a throwaway Docker container,
+// giving each build its own Go toolchain and linter set instead of
+// pinning every repo to whatever is installed on the worker host.
+type DockerRunner struct {
+	image   string
+	env     []string
+	timeout time.Duration
+	limits  ResourceLimits
+	logger  Logger
+}
+
+// ResourceLimits caps what a single container build may use.
+type ResourceLimits struct {
+	CPUs     float64
+	MemoryMB int64
+}
+
+// NewDockerRunner builds a DockerRunner from a repo's overrides,
+// falling back to the worker-wide defaults in config for anything left
+// unset.
+func NewDockerRunner(config *Cfg, repoCfg RepoCfg, logger Logger) *DockerRunner {
+	image := repoCfg.Image
+	if image == "" {
+		image = config.DefaultLinterImage
+	}
+
+	timeout := repoCfg.LinterTimeout
+	if timeout <= 0 {
+		timeout = config.DefaultLinterTimeout
+	}
+	if timeout <= 0 {
+		timeout = defaultLinterTimeout
+	}
+
+	return &DockerRunner{
+		image:   image,
+		env:     append(config.DefaultLinterEnv, repoCfg.ExtraEnv...),
+		timeout: timeout,
+		limits:  repoCfg.ResourceLimits,
+		logger:  logger.Fields(map[string]interface{}{"stage": "runner"}),
+	}
+}
+
+func (r *DockerRunner) Run(ctx context.Context, cmd []string, checkoutPath string, onLine func(line string)) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	containerID, err := r.createContainer(ctx, cmd, checkoutPath)
+	if err != nil {
+		return -1, fmt.Errorf("can't create container: %v", err)
+	}
+	defer r.removeContainer(containerID)
+
+	if err := r.startContainer(ctx, containerID); err != nil {
+		return -1, fmt.Errorf("can't start container: %v", err)
+	}
+
+	raw, err := r.attachLogs(ctx, containerID)
+	if err != nil {
+		return -1, fmt.Errorf("can't attach to container logs: %v", err)
+	}
+	defer raw.Close()
+
+	if err := demuxLines(raw, onLine); err != nil {
+		return -1, fmt.Errorf("error streaming container logs: %v", err)
+	}
+
+	exitCode, err := r.wait(ctx, containerID)
+	if err != nil {
+		return -1, fmt.Errorf("can't wait for container: %v", err)
+	}
+
+	return exitCode, nil
+}
+
+// demuxLines splits raw - the multiplexed stdout/stderr stream
+// ContainerLogs returns for a container created with Tty: false, per
+// Docker's stream format - back into plain per-line text, calling
+// onLine for each line from either stream as it arrives.
+func demuxLines(raw io.Reader, onLine func(line string)) error {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+
+	var demuxErr error
+	go func() {
+		_, demuxErr = stdcopy.StdCopy(stdoutW, stderrW, raw)
+		stdoutW.Close()
+		stderrW.Close()
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdoutR, stderrR} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				mu.Lock()
+				onLine(scanner.Text())
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	return demuxErr
+}
+
+// The methods below talk to the Docker daemon. They're kept as thin,
+// separately-named steps (rather than inlined into Run) so Run's
+// always-clean-up-on-cancel contract is easy to audit: every container
+// that createContainer returns is guaranteed a matching removeContainer,
+// regardless of which later step fails.
+
+func (r *DockerRunner) createContainer(ctx context.Context, cmd []string, checkoutPath string) (string, error) {
+	return dockerCreate(ctx, r.image, cmd, checkoutPath, r.env, r.limits)
+}
+
+func (r *DockerRunner) startContainer(ctx context.Context, containerID string) error {
+	return dockerStart(ctx, containerID)
+}
+
+func (r *DockerRunner) attachLogs(ctx context.Context, containerID string) (io.ReadCloser, error) {
+	return dockerLogs(ctx, containerID)
+}
+
+func (r *DockerRunner) wait(ctx context.Context, containerID string) (int, error) {
+	return dockerWait(ctx, containerID)
+}
+
+func (r *DockerRunner) removeContainer(containerID string) {
+	if err := dockerRemove(containerID); err != nil {
+		r.logger.Errorf("can't remove container %s: %v", containerID, err)
+	}
+}
@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// WebhookHandler receives push notifications from a Git host (GitHub or
+// Gitea) and enqueues the affected repo for analysis, so continuous
+// analysis doesn't depend on the poller or a user manually triggering a
+// build.
+type WebhookHandler struct {
+	config  *Cfg
+	trigger func(repo string) error
+	logger  Logger
+}
+
+// NewWebhookHandler builds an http.Handler. trigger is called with the
+// repo name extracted from the push payload.
+func NewWebhookHandler(config *Cfg, trigger func(repo string) error, logger Logger) *WebhookHandler {
+	return &WebhookHandler{
+		config:  config,
+		trigger: trigger,
+		logger:  logger.Fields(map[string]interface{}{"stage": "webhook"}),
+	}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "can't read body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.verifySignature(r, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	// github.com has no self-hosted variant, so it's a safe default;
+	// Gitea is always self-hosted, so its host must come from config -
+	// same reasoning as gerritHead's DefaultGerritHost.
+	host := h.config.GitHubHost
+	if host == "" {
+		host = "github.com"
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = r.Header.Get("X-Gitea-Event")
+		host = h.config.GiteaHost
+	}
+	if event != "push" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if host == "" {
+		http.Error(w, "no gitea host configured for webhook", http.StatusInternalServerError)
+		return
+	}
+
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "can't decode payload", http.StatusBadRequest)
+		return
+	}
+
+	repo := payload.Repository.FullName
+	if repo == "" {
+		http.Error(w, "missing repository.full_name", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.trigger(host + "/" + repo); err != nil {
+		h.logger.Errorf("can't trigger analysis for %s: %v", repo, err)
+		http.Error(w, fmt.Sprintf("can't trigger analysis: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifySignature checks the HMAC signature GitHub/Gitea attach to the
+// request (X-Hub-Signature-256, falling back to the older
+// X-Hub-Signature) against the configured WebhookSecret.
+func (h *WebhookHandler) verifySignature(r *http.Request, body []byte) bool {
+	if h.config.WebhookSecret == "" {
+		return true
+	}
+
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(h.config.WebhookSecret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(expected))
+	}
+
+	if sig := r.Header.Get("X-Hub-Signature"); sig != "" {
+		mac := hmac.New(sha1.New, []byte(h.config.WebhookSecret))
+		mac.Write(body)
+		expected := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(expected))
+	}
+
+	return false
+}
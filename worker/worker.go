@@ -4,11 +4,12 @@ import (
 	"fmt"
 
 	"encoding/json"
-	"log"
+	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/qfarm/qfarm"
@@ -21,6 +22,11 @@ type Worker struct {
 	notifier *Notifier
 	coverage *CoverageChecker
 	config   *Cfg
+	poller   *Poller
+	webhook  *WebhookHandler
+	fetcher  *GitFetcher
+	logger   Logger
+	queue    *Queue
 }
 
 func NewWorker(config *Cfg) (*Worker, error) {
@@ -33,40 +39,173 @@ func NewWorker(config *Cfg) (*Worker, error) {
 	}
 
 	w.notifier = NewNotifier(w.redis)
-	w.linter = NewMetalinter(config, w.redis, w.notifier)
-	w.coverage = NewCoverageChecker(config, w.notifier)
+	// No build is in progress yet, so there's nothing to tee this
+	// logger into; analyze builds a build-scoped Logger once it knows
+	// the build number, which is when per-build Redis capture starts.
+	w.logger = NewLogger(nil)
+	// RepoCfg.Image/ExtraEnv/ResourceLimits let a repo override the
+	// default toolchain; Metalinter/CoverageChecker build their own
+	// per-build Runner from the RepoCfg they receive, this is just the
+	// worker-wide default used until a repo's config is loaded.
+	defaultRunner := NewDockerRunner(config, RepoCfg{}, w.logger)
+	w.linter = NewMetalinter(config, w.redis, w.notifier, defaultRunner)
+	w.coverage = NewCoverageChecker(config, w.notifier, defaultRunner)
+	w.poller = NewPoller(config, w.redis, w.notifier, w.enqueue, w.logger)
+	w.webhook = NewWebhookHandler(config, w.enqueue, w.logger)
+	w.fetcher = NewGitFetcher(config)
+	w.queue = NewQueue(w.redis, workerID(config), config)
 
 	return w, nil
 }
 
+// workerID identifies this process's claimed jobs in Redis; it only
+// needs to be unique among concurrently running workers.
+func workerID(config *Cfg) string {
+	if config.WorkerID != "" {
+		return config.WorkerID
+	}
+
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
 func (w *Worker) Run() error {
+	stop := make(chan struct{})
+	go w.poller.Run(stop)
+	go w.runReaper(stop)
+
+	if w.config.WebhookAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(w.config.WebhookAddr, w.webhook); err != nil {
+				w.logger.Fields(map[string]interface{}{"stage": "webhook"}).Errorf("server stopped: %v", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sig
+		w.logger.Infof("received shutdown signal, returning claimed jobs")
+		if err := w.queue.Shutdown(); err != nil {
+			w.logger.Errorf("can't return claimed jobs on shutdown: %v", err)
+		}
+		close(stop)
+		os.Exit(0)
+	}()
+
 	if err := w.redis.Subscribe("test-q-channel", w.fetchAndAnalyze); err != nil {
+		close(stop)
 		return err
 	}
 
 	return nil
 }
 
+// runReaper periodically returns jobs whose visibility timeout elapsed
+// without being acked or failed (e.g. because the worker holding them
+// crashed) to the shared queue.
+func (w *Worker) runReaper(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.queue.Reap(); err != nil {
+				w.logger.Fields(map[string]interface{}{"stage": "reap"}).Errorf("reap failed: %v", err)
+			}
+		}
+	}
+}
+
+// enqueue pushes repo onto the analysis queue and publishes it on
+// test-q-channel to wake up a worker; used by both the poller and the
+// webhook receiver to trigger a build.
+func (w *Worker) enqueue(repo string) error {
+	if err := w.redis.ListPush("test-q-list", []byte(repo)); err != nil {
+		return err
+	}
+
+	return w.redis.Publish("test-q-channel", repo)
+}
+
 func (w *Worker) fetchAndAnalyze(data interface{}) error {
-	elem, err := w.redis.ListPop("test-q-list") // TODO: drain list to the bottom
+	job, err := w.queue.Claim()
+	if err == redis.ErrNotFound {
+		// another worker claimed it first
+		return nil
+	}
 	if err != nil {
-		// do nothing other worker might got the value from list before
+		return err
+	}
+
+	stopHeartbeat := w.heartbeatJob(job)
+	analyzeErr := w.analyze(job.Repo, "")
+	stopHeartbeat()
+
+	if analyzeErr != nil {
+		w.notifier.SendEvent(job.Repo, fmt.Sprintf("Error: %s", analyzeErr.Error()), EventTypeError)
+		w.logger.Fields(map[string]interface{}{"repo": job.Repo, "stage": "analyze"}).Errorf("worker analysis failed: %v", analyzeErr)
+
+		if failErr := w.queue.Fail(job); failErr != nil {
+			w.logger.Errorf("can't requeue failed job for %s: %v", job.Repo, failErr)
+		}
 		return nil
 	}
 
-	if err := w.analyze(string(elem.([]byte))); err != nil {
-		w.notifier.SendEvent(string(elem.([]byte)), fmt.Sprintf("Error: %s", err.Error()), EventTypeError)
-		log.Printf("Error during worker analysis! Err: %v \n", err)
+	if err := w.queue.Ack(job); err != nil {
+		w.logger.Errorf("can't ack finished job for %s: %v", job.Repo, err)
 	}
 
 	return nil
 }
 
-func (w *Worker) analyze(repo string) error {
+// heartbeatJob extends job's in-progress visibility deadline at
+// queue.heartbeatInterval() for as long as the returned stop func
+// hasn't been called, so a build that outlives the queue's visibility
+// timeout isn't reaped and re-claimed by a second worker while this one
+// is still working on it. The caller must call stop once analyze
+// finishes, which blocks until the heartbeat goroutine has exited.
+func (w *Worker) heartbeatJob(job Job) (stop func()) {
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(w.queue.heartbeatInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if err := w.queue.Heartbeat(job); err != nil {
+					w.logger.Fields(map[string]interface{}{"repo": job.Repo, "stage": "heartbeat"}).Errorf("can't extend claim: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+		<-done
+	}
+}
+
+// analyze fetches repo and runs a full build against it. ref pins the
+// checkout to a specific branch, tag or commit sha; pass "" to build
+// the remote's default branch (the common case for a freshly queued
+// job), or a historical Build.CommitHash to re-run an old build.
+func (w *Worker) analyze(repo, ref string) error {
 	start := time.Now()
+	logger := w.logger.Fields(map[string]interface{}{"repo": repo, "stage": "fetch"})
 
 	// download repo
-	if err := w.download(repo); err != nil {
+	if err := w.download(repo, ref); err != nil {
 		return err
 	}
 
@@ -79,7 +218,7 @@ func (w *Worker) analyze(repo string) error {
 		return err
 	}
 
-	log.Printf("Hash of last commit %s", lastCommitHash)
+	logger.Infof("hash of last commit %s", lastCommitHash)
 
 	// get last build number
 	firstTimeBuild := false
@@ -108,8 +247,13 @@ func (w *Worker) analyze(repo string) error {
 		newBuild.No = buildInfo.No + 1
 	}
 
+	// From here on the build number is known, so tee every log line
+	// into Redis under logs:<repo>:<no> for the frontend's live tail.
+	buildLog := NewBuildLog(w.redis, w.notifier, repo, newBuild.No)
+	logger = NewLogger(buildLog.Sink).Fields(map[string]interface{}{"repo": repo, "build_no": newBuild.No})
+
 	// create repo config
-	buildCfg, err := LoadRepoCfg(repo, path.Join(os.Getenv("GOPATH"), "src", repo))
+	buildCfg, err := LoadRepoCfg(repo, gopathSrc(repo))
 	if err != nil {
 		return err
 	}
@@ -122,15 +266,26 @@ func (w *Worker) analyze(repo string) error {
 	}
 
 	// run all linters
+	logger.Fields(map[string]interface{}{"stage": "lint"}).Infof("starting linters")
 	if err := w.linter.Start(*buildCfg, newBuild.No, ft); err != nil {
 		return err
 	}
 
 	// run coverage
+	logger.Fields(map[string]interface{}{"stage": "coverage"}).Infof("starting coverage")
 	if err := w.coverage.Start(*buildCfg, ft); err != nil {
 		return err
 	}
 
+	// storeTree must run before storeNodes: storeNodes mutates each
+	// node's Path/ParentPath in place (FilesMap holds pointers) to
+	// strip the path down to the repo-relative form it exposes to the
+	// frontend, and diffBuilds needs the untouched, still-absolute
+	// paths to match up against the relative paths `git diff` reports.
+	if err := w.storeTree(repo, newBuild.No, ft); err != nil {
+		return fmt.Errorf("can't store file tree in Redis: %v", err)
+	}
+
 	if err := w.storeNodes(buildCfg.Repo, newBuild.No, ft); err != nil {
 		return fmt.Errorf("can't store nodes in Redis: %v", err)
 	}
@@ -180,12 +335,58 @@ func (w *Worker) analyze(repo string) error {
 		return err
 	}
 
+	if !firstTimeBuild {
+		if err := w.diffAgainstPreviousBuild(repo, r, buildInfo); err != nil {
+			// a missing or unparsable diff shouldn't fail the whole
+			// build, the report itself already succeeded
+			logger.Fields(map[string]interface{}{"stage": "diff"}).Errorf("can't compute build diff: %v", err)
+		}
+	}
+
 	w.notifier.SendEventWithPayload(repo, "All tasks done!", EventTypeAllDone, fmt.Sprintf("%d", newBuild.No))
 
-	fmt.Printf("All done\n")
+	logger.Fields(map[string]interface{}{"stage": "done"}).Infof("all tasks done")
 	return nil
 }
 
+// storeTree persists the full file tree for a build so a later build's
+// diffAgainstPreviousBuild can load it back to compare issues and
+// coverage against, in addition to the per-node entries storeNodes
+// exposes to the frontend.
+func (w *Worker) storeTree(repo string, no int, ft *FilesMap) error {
+	data, err := json.Marshal(ft)
+	if err != nil {
+		return err
+	}
+
+	return w.redis.Set(fmt.Sprintf("trees:%s:%d", repo, no), -1, string(data))
+}
+
+// diffAgainstPreviousBuild computes and persists the BuildDiff between
+// this build and the one it supersedes, using the commit range recorded
+// on both builds to translate the previous build's issue lines forward.
+// This build's tree is loaded back from the copy storeTree saved, since
+// the in-memory one has had its paths stripped by storeNodes.
+func (w *Worker) diffAgainstPreviousBuild(repo string, report qfarm.Report, previous qfarm.Report) error {
+	newTree, err := w.loadFileTree(repo, report.No)
+	if err != nil {
+		return err
+	}
+
+	oldTree, err := w.loadFileTree(repo, previous.No)
+	if err != nil {
+		return err
+	}
+
+	diff, err := diffBuilds(repo, report, newTree, oldTree, previous.CommitHash, report.CommitHash)
+	if err != nil {
+		return err
+	}
+	diff.ScoreDelta = report.Score - previous.Score
+
+	return w.storeBuildDiff(diff)
+}
+
 const (
 	CostOfWarning = 10
 	CostOfError   = 14
@@ -259,13 +460,21 @@ func (w *Worker) getLastBuildInfo(repo string) (qfarm.Report, error) {
 	return build, nil
 }
 
-func (w *Worker) download(repo string) error {
-	fmt.Printf("Downloading %s...\n", repo)
-	if err := exec.Command("go", "get", "-u", "-t", path.Join(repo, "...")).Run(); err != nil {
+// download makes sure repo is checked out at ref (or the remote's
+// default branch, if ref is empty) under GOPATH, fetching only the
+// changes since the last build instead of the whole dependency tree.
+func (w *Worker) download(repo, ref string) error {
+	logger := w.logger.Fields(map[string]interface{}{"repo": repo, "stage": "fetch"})
+
+	logger.Infof("downloading %s...", repo)
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if err := w.fetcher.Fetch(repo, ref); err != nil {
 		return err
 	}
 
-	fmt.Printf("Repo %s downloaded!\n", repo)
+	logger.Infof("repo %s downloaded", repo)
 
 	w.notifier.SendEvent(repo, fmt.Sprintf("Repo %s downloaded", repo), EventTypeDownloadDone)
 
@@ -280,7 +489,7 @@ func (w *Worker) markAsUserRepo(repo string) error {
 }
 
 func lastCommitHash(repo string) (string, error) {
-	repoPath := path.Join(os.Getenv("GOPATH"), "src", repo)
+	repoPath := gopathSrc(repo)
 
 	cmd := exec.Command("git", "rev-parse", "HEAD")
 	cmd.Dir = repoPath